@@ -0,0 +1,417 @@
+package vault
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/helper/pgpkeys"
+	"github.com/hashicorp/vault/helper/xor"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/shamir"
+)
+
+// defaultRootGenerationMaxDuration is the lifetime given to a root
+// generation attempt when the caller does not specify one. An abandoned
+// attempt is auto-cancelled once it expires, rather than sitting in
+// memory until an operator remembers to cancel it.
+const defaultRootGenerationMaxDuration = 10 * time.Minute
+
+// RootGenerationInitConfig configures a new root generation attempt.
+type RootGenerationInitConfig struct {
+	OTP          string
+	PGPKeys      []string
+	PGPThreshold int
+
+	// MaxDuration is how long the attempt is allowed to remain
+	// in-progress before it is auto-cancelled. Defaults to
+	// defaultRootGenerationMaxDuration when zero.
+	MaxDuration time.Duration
+
+	// Requestor identifies the operator starting the attempt, for the
+	// audit trail. May be empty if unauthenticated.
+	Requestor string
+}
+
+// RootGenerationConfig is returned to callers so they can observe the
+// state of an in-progress root generation attempt.
+type RootGenerationConfig struct {
+	Nonce        string
+	PGPKeys      []string
+	PGPThreshold int
+	Required     int
+	Progress     int
+	StartedAt    time.Time
+	ExpiresAt    time.Time
+}
+
+// PGPKeyShare is one recipient's Shamir share of the generated root
+// token, encrypted to that recipient's PGP key.
+type PGPKeyShare struct {
+	Fingerprint    string
+	EncryptedShare string
+}
+
+// RootGenerationResult holds the root token material produced once a
+// root generation attempt has collected enough unseal key shares.
+//
+// EncodedRootToken is populated for the OTP mode and for the legacy
+// single-PGP-key mode. PGPShares is populated instead when the attempt
+// was configured with more than one PGP recipient; any PGPThreshold of
+// the decrypted shares can be combined offline with vault/rootgen to
+// reconstruct the root token.
+type RootGenerationResult struct {
+	EncodedRootToken string
+	PGPShares        []PGPKeyShare
+}
+
+// rootGenerationState tracks the unseal key shares submitted so far
+// toward the threshold required to complete a root generation attempt.
+type rootGenerationState struct {
+	nonce        string
+	otp          string
+	pgpKeys      []string
+	pgpThreshold int
+
+	// requestor is the operator who started the attempt via
+	// RootGenerationInit. It does not change for the life of the
+	// attempt; per-share submitter identity is tracked separately in
+	// submitters below.
+	requestor string
+
+	required  int
+	startedAt time.Time
+	expiresAt time.Time
+
+	// shares holds the raw unseal key shares submitted so far. fingerprints
+	// records a hash of each share already counted, so the same share
+	// cannot be replayed to count twice toward the threshold. submitters
+	// records, for each entry in shares (by index), the identity supplied
+	// to the RootGenerationUpdate call that submitted it.
+	shares       [][]byte
+	fingerprints map[string]struct{}
+	submitters   []string
+}
+
+// RootGenerationInit is used to initialize the root generation attempt.
+// Only one attempt may be in progress at a time. The number of distinct
+// unseal key shares required to complete the attempt is taken from the
+// barrier's seal configuration, so a single-share seal behaves exactly
+// as it always has.
+//
+// config.PGPKeys supplies zero or more PGP public keys (armored) to
+// encrypt the resulting root token to. With a single key,
+// RootGenerationUpdate returns one EncodedRootToken, as it always has.
+// With more than one key, the root token is instead Shamir-split into
+// len(config.PGPKeys) shares requiring config.PGPThreshold of them to
+// reconstruct, and each share is encrypted to the corresponding
+// recipient and returned via PGPShares. config.PGPThreshold is ignored
+// when fewer than two PGP keys are supplied.
+func (c *Core) RootGenerationInit(config *RootGenerationInitConfig) error {
+	c.rootGenerationLock.Lock()
+	defer c.rootGenerationLock.Unlock()
+
+	c.expireRootGenerationLocked()
+
+	if c.sealed {
+		return fmt.Errorf("vault is sealed")
+	}
+	if c.rootGeneration != nil {
+		return fmt.Errorf("root generation already in progress")
+	}
+
+	otp, pgpKeys, pgpThreshold := config.OTP, config.PGPKeys, config.PGPThreshold
+	if len(otp) == 0 && len(pgpKeys) == 0 {
+		return fmt.Errorf("otp or pgp_keys must be provided")
+	}
+	if len(otp) > 0 && len(pgpKeys) > 0 {
+		return fmt.Errorf("otp and pgp_keys cannot both be provided")
+	}
+	for _, pgpKey := range pgpKeys {
+		if _, err := pgpkeys.GetEntity(pgpKey); err != nil {
+			return fmt.Errorf("error parsing pgp key: %v", err)
+		}
+	}
+	if len(pgpKeys) > 1 {
+		if pgpThreshold < 2 || pgpThreshold > len(pgpKeys) {
+			return fmt.Errorf("pgp_threshold must be between 2 and the number of pgp_keys")
+		}
+	} else if len(pgpKeys) == 1 {
+		pgpThreshold = 1
+	}
+
+	barrierConfig, err := c.seal.BarrierConfig()
+	if err != nil {
+		return fmt.Errorf("unable to look up barrier configuration: %v", err)
+	}
+	if barrierConfig == nil {
+		return fmt.Errorf("barrier has not been initialized")
+	}
+
+	nonce, err := uuid.GenerateUUID()
+	if err != nil {
+		return fmt.Errorf("error generating nonce: %v", err)
+	}
+
+	maxDuration := config.MaxDuration
+	if maxDuration <= 0 {
+		maxDuration = defaultRootGenerationMaxDuration
+	}
+	startedAt := time.Now()
+
+	c.rootGeneration = &rootGenerationState{
+		nonce:        nonce,
+		otp:          otp,
+		pgpKeys:      pgpKeys,
+		pgpThreshold: pgpThreshold,
+		requestor:    config.Requestor,
+		required:     barrierConfig.SecretThreshold,
+		startedAt:    startedAt,
+		expiresAt:    startedAt.Add(maxDuration),
+		fingerprints: make(map[string]struct{}),
+	}
+
+	c.auditRootGenerationEvent("init", config.Requestor, c.rootGeneration, "", nil)
+	return nil
+}
+
+// RootGenerationProgress returns the number of distinct unseal key
+// shares submitted so far toward the current root generation attempt.
+func (c *Core) RootGenerationProgress() (int, error) {
+	c.rootGenerationLock.Lock()
+	defer c.rootGenerationLock.Unlock()
+
+	c.expireRootGenerationLocked()
+
+	if c.rootGeneration == nil {
+		return 0, nil
+	}
+	return len(c.rootGeneration.shares), nil
+}
+
+// RootGenerationConfiguration returns the configuration of the current
+// root generation attempt, or nil if none is in progress or the
+// previous attempt has expired.
+func (c *Core) RootGenerationConfiguration() (*RootGenerationConfig, error) {
+	c.rootGenerationLock.Lock()
+	defer c.rootGenerationLock.Unlock()
+
+	c.expireRootGenerationLocked()
+
+	if c.rootGeneration == nil {
+		return nil, nil
+	}
+	return &RootGenerationConfig{
+		Nonce:        c.rootGeneration.nonce,
+		PGPKeys:      c.rootGeneration.pgpKeys,
+		PGPThreshold: c.rootGeneration.pgpThreshold,
+		Required:     c.rootGeneration.required,
+		Progress:     len(c.rootGeneration.shares),
+		StartedAt:    c.rootGeneration.startedAt,
+		ExpiresAt:    c.rootGeneration.expiresAt,
+	}, nil
+}
+
+// RootGenerationCancel aborts any in-progress root generation attempt.
+// It is safe to call even if no attempt is in progress.
+func (c *Core) RootGenerationCancel(requestor string) error {
+	c.rootGenerationLock.Lock()
+	defer c.rootGenerationLock.Unlock()
+
+	c.expireRootGenerationLocked()
+
+	if c.rootGeneration != nil {
+		c.auditRootGenerationEvent("cancel", requestor, c.rootGeneration, "", nil)
+	}
+	c.rootGeneration = nil
+	return nil
+}
+
+// expireRootGenerationLocked auto-cancels the in-progress root
+// generation attempt if its MaxDuration has elapsed. Callers must hold
+// rootGenerationLock.
+func (c *Core) expireRootGenerationLocked() {
+	rootGen := c.rootGeneration
+	if rootGen == nil || time.Now().Before(rootGen.expiresAt) {
+		return
+	}
+
+	maxDuration := rootGen.expiresAt.Sub(rootGen.startedAt)
+	c.auditRootGenerationEvent("expire", "", rootGen, "", fmt.Errorf("attempt expired after %s", maxDuration))
+	c.rootGeneration = nil
+}
+
+// RootGenerationUpdate submits a single unseal key share toward the
+// current root generation attempt. Once a threshold of distinct shares
+// has been submitted, the shares are combined into the master key and
+// a new root token is generated, OTP-XOR'd or PGP-encrypted per the
+// attempt's configuration.
+func (c *Core) RootGenerationUpdate(key []byte, nonce string, requestor string) (*RootGenerationResult, error) {
+	c.rootGenerationLock.Lock()
+	defer c.rootGenerationLock.Unlock()
+
+	c.expireRootGenerationLocked()
+
+	if c.sealed {
+		return nil, fmt.Errorf("vault is sealed")
+	}
+	if c.rootGeneration == nil {
+		return nil, fmt.Errorf("no root generation in progress")
+	}
+	if nonce != c.rootGeneration.nonce {
+		return nil, fmt.Errorf("incorrect nonce supplied; nonce for this root generation operation is %s", c.rootGeneration.nonce)
+	}
+
+	fingerprint := fmt.Sprintf("%x", sha256.Sum256(key))
+	if _, ok := c.rootGeneration.fingerprints[fingerprint]; ok {
+		err := fmt.Errorf("key share already submitted")
+		c.auditRootGenerationEvent("update", requestor, c.rootGeneration, fingerprint, err)
+		return nil, err
+	}
+
+	c.rootGeneration.shares = append(c.rootGeneration.shares, key)
+	c.rootGeneration.fingerprints[fingerprint] = struct{}{}
+	c.rootGeneration.submitters = append(c.rootGeneration.submitters, requestor)
+	c.auditRootGenerationEvent("update", requestor, c.rootGeneration, fingerprint, nil)
+
+	if len(c.rootGeneration.shares) < c.rootGeneration.required {
+		return nil, nil
+	}
+
+	// Threshold met: combine the shares into the master key. A
+	// single-share seal is simply the degenerate case of Shamir's
+	// scheme, so this path also covers the legacy single-key flow.
+	var masterKey []byte
+	var err error
+	if c.rootGeneration.required == 1 {
+		masterKey = c.rootGeneration.shares[0]
+	} else {
+		masterKey, err = shamir.Combine(c.rootGeneration.shares)
+		if err != nil {
+			c.rootGeneration.shares = nil
+			c.rootGeneration.fingerprints = make(map[string]struct{})
+			c.rootGeneration.submitters = nil
+			return nil, fmt.Errorf("failed to compute master key: %v", err)
+		}
+	}
+
+	if err := c.barrier.VerifyMaster(masterKey); err != nil {
+		c.rootGeneration.shares = nil
+		c.rootGeneration.fingerprints = make(map[string]struct{})
+		c.rootGeneration.submitters = nil
+		return nil, fmt.Errorf("master key verification failed: %v", err)
+	}
+
+	rootGen := c.rootGeneration
+	c.rootGeneration = nil
+
+	te, err := c.tokenStore.rootToken()
+	if err != nil {
+		c.auditRootGenerationCompletion(rootGen, err)
+		return nil, fmt.Errorf("failed to generate root token: %v", err)
+	}
+
+	result, err := rootGen.encodeToken(te.ID)
+	c.auditRootGenerationCompletion(rootGen, err)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// auditRootGenerationCompletion audits the end of a root generation
+// attempt, distinguishing a successful token mint ("complete") from a
+// failure to produce one ("failure") so that an operator scanning the
+// audit log for completed root generations doesn't mistake a failed
+// attempt for one that actually minted a token. It also records the
+// submitter of each counted share, one entry per share, so an operator
+// who submitted several shares appears once for each of them.
+func (c *Core) auditRootGenerationCompletion(rootGen *rootGenerationState, opErr error) {
+	op := "complete"
+	if opErr != nil {
+		op = "failure"
+	}
+	c.auditRootGenerationEvent(op, rootGen.requestor, rootGen, "", opErr)
+}
+
+// encodeToken produces the caller-facing RootGenerationResult for a
+// freshly generated root token ID, per the attempt's OTP/PGP mode.
+func (rootGen *rootGenerationState) encodeToken(tokenID string) (*RootGenerationResult, error) {
+	switch {
+	case len(rootGen.otp) > 0:
+		encodedToken, err := xor.XORBase64(tokenID, rootGen.otp)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding root token: %v", err)
+		}
+		return &RootGenerationResult{EncodedRootToken: encodedToken}, nil
+
+	case len(rootGen.pgpKeys) == 1:
+		_, encryptedTokens, err := pgpkeys.EncryptShares([][]byte{[]byte(tokenID)}, rootGen.pgpKeys)
+		if err != nil {
+			return nil, fmt.Errorf("error encrypting root token: %v", err)
+		}
+		return &RootGenerationResult{EncodedRootToken: encryptedTokens[0]}, nil
+
+	default:
+		tokenBytes, err := uuid.ParseUUID(tokenID)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing root token: %v", err)
+		}
+		tokenShares, err := shamir.Split(tokenBytes, len(rootGen.pgpKeys), rootGen.pgpThreshold)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split root token: %v", err)
+		}
+		fingerprints, encryptedShares, err := pgpkeys.EncryptShares(tokenShares, rootGen.pgpKeys)
+		if err != nil {
+			return nil, fmt.Errorf("error encrypting root token shares: %v", err)
+		}
+
+		pgpShares := make([]PGPKeyShare, len(encryptedShares))
+		for i, encryptedShare := range encryptedShares {
+			pgpShares[i] = PGPKeyShare{
+				Fingerprint:    fingerprints[i],
+				EncryptedShare: encryptedShare,
+			}
+		}
+		return &RootGenerationResult{PGPShares: pgpShares}, nil
+	}
+}
+
+// auditRootGenerationEvent writes a single root generation lifecycle
+// event through the audit broker so that root token creation is
+// forensically traceable. actor is the identity the event is attributed
+// to: the operator who made the call for init, update and cancel events,
+// the operator who started the attempt (rootGen.requestor) for complete
+// and failure events, and empty for expiry. It is used as-is, rather
+// than inferred from attempt state that other callers may have since
+// overwritten. A failure to audit-log is logged and swallowed rather
+// than returned: this is operational housekeeping around the attempt,
+// not the security-sensitive action itself (the state change being
+// audited has already been made by the time this is called).
+func (c *Core) auditRootGenerationEvent(op, actor string, rootGen *rootGenerationState, shareFingerprint string, opErr error) {
+	if c.auditBroker == nil || rootGen == nil {
+		return
+	}
+
+	req := &logical.Request{
+		Operation: logical.Operation("root-generation/" + op),
+		Path:      "sys/generate-root",
+		Data: map[string]interface{}{
+			"nonce":     rootGen.nonce,
+			"requestor": rootGen.requestor,
+		},
+	}
+	if shareFingerprint != "" {
+		req.Data["share_fingerprint"] = shareFingerprint
+	}
+	if len(rootGen.submitters) > 0 {
+		req.Data["share_submitters"] = append([]string(nil), rootGen.submitters...)
+	}
+
+	auth := &logical.Auth{DisplayName: actor}
+
+	if err := c.auditBroker.LogRequest(auth, req, opErr); err != nil {
+		c.logger.Printf("[ERR] core: failed to audit-log root generation %q event: %v", op, err)
+	}
+}
@@ -3,17 +3,19 @@ package vault
 import (
 	"encoding/base64"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/go-uuid"
 	"github.com/hashicorp/vault/helper/pgpkeys"
 	"github.com/hashicorp/vault/helper/xor"
+	"github.com/hashicorp/vault/vault/rootgen"
 )
 
 func TestCore_RootGeneration_Lifecycle(t *testing.T) {
 	c, master, _ := TestCoreUnsealed(t)
 
 	// Verify update not allowed
-	if _, err := c.RootGenerationUpdate(master, ""); err == nil {
+	if _, err := c.RootGenerationUpdate(master, "", ""); err == nil {
 		t.Fatalf("no root generation in progress")
 	}
 
@@ -36,7 +38,7 @@ func TestCore_RootGeneration_Lifecycle(t *testing.T) {
 	}
 
 	// Cancel should be idempotent
-	err = c.RootGenerationCancel()
+	err = c.RootGenerationCancel("")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -47,7 +49,7 @@ func TestCore_RootGeneration_Lifecycle(t *testing.T) {
 	}
 
 	// Start a root generation
-	err = c.RootGenerationInit(base64.StdEncoding.EncodeToString(otpBytes), "")
+	err = c.RootGenerationInit(&RootGenerationInitConfig{OTP: base64.StdEncoding.EncodeToString(otpBytes)})
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -59,7 +61,7 @@ func TestCore_RootGeneration_Lifecycle(t *testing.T) {
 	}
 
 	// Cancel should be clear
-	err = c.RootGenerationCancel()
+	err = c.RootGenerationCancel("")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -82,13 +84,13 @@ func TestCore_RootGeneration_Init(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = c.RootGenerationInit(base64.StdEncoding.EncodeToString(otpBytes), "")
+	err = c.RootGenerationInit(&RootGenerationInitConfig{OTP: base64.StdEncoding.EncodeToString(otpBytes)})
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
 	// Second should fail
-	err = c.RootGenerationInit("", pgpkeys.TestPubKey1)
+	err = c.RootGenerationInit(&RootGenerationInitConfig{PGPKeys: []string{pgpkeys.TestPubKey1}, PGPThreshold: 1})
 	if err == nil {
 		t.Fatalf("should fail")
 	}
@@ -102,7 +104,7 @@ func TestCore_RootGeneration_InvalidMaster(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = c.RootGenerationInit(base64.StdEncoding.EncodeToString(otpBytes), "")
+	err = c.RootGenerationInit(&RootGenerationInitConfig{OTP: base64.StdEncoding.EncodeToString(otpBytes)})
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -118,7 +120,7 @@ func TestCore_RootGeneration_InvalidMaster(t *testing.T) {
 
 	// Provide the master (invalid)
 	master[0]++
-	_, err = c.RootGenerationUpdate(master, rgconf.Nonce)
+	_, err = c.RootGenerationUpdate(master, rgconf.Nonce, "")
 	if err == nil {
 		t.Fatalf("expected error")
 	}
@@ -132,13 +134,13 @@ func TestCore_RootGeneration_InvalidNonce(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = c.RootGenerationInit(base64.StdEncoding.EncodeToString(otpBytes), "")
+	err = c.RootGenerationInit(&RootGenerationInitConfig{OTP: base64.StdEncoding.EncodeToString(otpBytes)})
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
 
 	// Provide the nonce (invalid)
-	_, err = c.RootGenerationUpdate(master, "abcd")
+	_, err = c.RootGenerationUpdate(master, "abcd", "")
 	if err == nil {
 		t.Fatalf("expected error")
 	}
@@ -154,7 +156,7 @@ func TestCore_RootGeneration_Update_OTP(t *testing.T) {
 
 	otp := base64.StdEncoding.EncodeToString(otpBytes)
 	// Start a root generation
-	err = c.RootGenerationInit(otp, "")
+	err = c.RootGenerationInit(&RootGenerationInitConfig{OTP: otp})
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -169,7 +171,7 @@ func TestCore_RootGeneration_Update_OTP(t *testing.T) {
 	}
 
 	// Provide the master
-	result, err := c.RootGenerationUpdate(master, rkconf.Nonce)
+	result, err := c.RootGenerationUpdate(master, rkconf.Nonce, "")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -220,11 +222,132 @@ func TestCore_RootGeneration_Update_OTP(t *testing.T) {
 	}
 }
 
+func TestCore_RootGeneration_Quorum_Progress(t *testing.T) {
+	c, keys, _ := TestCoreUnsealedWithConfig(t, &SealConfig{SecretShares: 5, SecretThreshold: 3})
+
+	otpBytes, err := xor.GenerateRandBytes(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otp := base64.StdEncoding.EncodeToString(otpBytes)
+
+	if err := c.RootGenerationInit(&RootGenerationInitConfig{OTP: otp}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	rgconf, err := c.RootGenerationConfiguration()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if rgconf.Required != 3 {
+		t.Fatalf("bad: expected threshold of 3, got %d", rgconf.Required)
+	}
+
+	// Submit shares one at a time, checking that progress advances and
+	// that no result is returned until the threshold is met.
+	for i := 0; i < 2; i++ {
+		result, err := c.RootGenerationUpdate(keys[i], rgconf.Nonce, "")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if result != nil {
+			t.Fatalf("expected no result before threshold, got %#v", result)
+		}
+
+		num, err := c.RootGenerationProgress()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if num != i+1 {
+			t.Fatalf("bad: expected progress %d, got %d", i+1, num)
+		}
+	}
+
+	// Resubmitting a share already counted must not advance progress.
+	if _, err := c.RootGenerationUpdate(keys[0], rgconf.Nonce, ""); err == nil {
+		t.Fatalf("expected error resubmitting the same share")
+	}
+	num, err := c.RootGenerationProgress()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if num != 2 {
+		t.Fatalf("bad: duplicate share counted toward progress: %d", num)
+	}
+
+	// The final distinct share should complete the attempt.
+	result, err := c.RootGenerationUpdate(keys[2], rgconf.Nonce, "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if result == nil {
+		t.Fatalf("expected a result once threshold was met")
+	}
+
+	tokenBytes, err := xor.XORBase64(result.EncodedRootToken, otp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := uuid.FormatUUID(tokenBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	te, err := c.tokenStore.Lookup(token)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if te == nil || len(te.Policies) != 1 || te.Policies[0] != "root" {
+		t.Fatalf("bad: %#v", te)
+	}
+}
+
+func TestCore_RootGeneration_Quorum_WrongShare(t *testing.T) {
+	c, keys, _ := TestCoreUnsealedWithConfig(t, &SealConfig{SecretShares: 5, SecretThreshold: 3})
+
+	otpBytes, err := xor.GenerateRandBytes(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otp := base64.StdEncoding.EncodeToString(otpBytes)
+
+	if err := c.RootGenerationInit(&RootGenerationInitConfig{OTP: otp}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	rgconf, err := c.RootGenerationConfiguration()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := c.RootGenerationUpdate(keys[0], rgconf.Nonce, ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := c.RootGenerationUpdate(keys[1], rgconf.Nonce, ""); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A bogus final share combines to a master key that won't verify.
+	bogus := make([]byte, len(keys[2]))
+	copy(bogus, keys[2])
+	bogus[0]++
+	if _, err := c.RootGenerationUpdate(bogus, rgconf.Nonce, ""); err == nil {
+		t.Fatalf("expected error from invalid share combination")
+	}
+
+	// Progress should have been reset so the operator can retry cleanly.
+	num, err := c.RootGenerationProgress()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if num != 0 {
+		t.Fatalf("bad: expected progress to reset after invalid combination, got %d", num)
+	}
+}
+
 func TestCore_RootGeneration_Update_PGP(t *testing.T) {
 	c, master, _ := TestCoreUnsealed(t)
 
 	// Start a root generation
-	err := c.RootGenerationInit("", pgpkeys.TestPubKey1)
+	err := c.RootGenerationInit(&RootGenerationInitConfig{PGPKeys: []string{pgpkeys.TestPubKey1}, PGPThreshold: 1})
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -239,7 +362,7 @@ func TestCore_RootGeneration_Update_PGP(t *testing.T) {
 	}
 
 	// Provide the master
-	result, err := c.RootGenerationUpdate(master, rkconf.Nonce)
+	result, err := c.RootGenerationUpdate(master, rkconf.Nonce, "")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -290,3 +413,231 @@ func TestCore_RootGeneration_Update_PGP(t *testing.T) {
 		t.Fatalf("bad: %#v", *te)
 	}
 }
+
+func TestCore_RootGeneration_Update_PGP_MultiRecipient(t *testing.T) {
+	c, master, _ := TestCoreUnsealed(t)
+
+	pgpKeys := []string{
+		pgpkeys.TestPubKey1,
+		pgpkeys.TestPubKey2,
+		pgpkeys.TestPubKey3,
+	}
+	privKeys := []string{
+		pgpkeys.TestPrivKey1,
+		pgpkeys.TestPrivKey2,
+		pgpkeys.TestPrivKey3,
+	}
+
+	// Start a root generation split across 3 recipients, requiring all 3
+	// to reconstruct the token.
+	err := c.RootGenerationInit(&RootGenerationInitConfig{PGPKeys: pgpKeys, PGPThreshold: 3})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	rkconf, err := c.RootGenerationConfiguration()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if rkconf == nil {
+		t.Fatalf("bad: no root generation config received")
+	}
+
+	result, err := c.RootGenerationUpdate(master, rkconf.Nonce, "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if result == nil || len(result.PGPShares) != 3 {
+		t.Fatalf("bad: expected 3 pgp shares, got %#v", result)
+	}
+
+	// Decrypt all 3 shares and recombine.
+	decrypted := make([][]byte, 0, 3)
+	for i := 0; i < 3; i++ {
+		ptBuf, err := pgpkeys.DecryptBytes(result.PGPShares[i].EncryptedShare, privKeys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted = append(decrypted, ptBuf.Bytes())
+	}
+
+	token, err := rootgen.Recombine(decrypted)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ensure that the token is a root token
+	te, err := c.tokenStore.Lookup(token)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if te == nil {
+		t.Fatalf("token was nil")
+	}
+	if te.ID != token || te.Parent != "" ||
+		len(te.Policies) != 1 || te.Policies[0] != "root" {
+		t.Fatalf("bad: %#v", *te)
+	}
+
+	// Fewer than the threshold (but still >= 2, the minimum shamir.Combine
+	// accepts) should not reconstruct the correct token.
+	bad, err := rootgen.Recombine(decrypted[0:2])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if bad == token {
+		t.Fatalf("bad: reconstructed token below threshold")
+	}
+}
+
+func TestCore_RootGeneration_Expiry(t *testing.T) {
+	c, master, _ := TestCoreUnsealed(t)
+
+	otpBytes, err := xor.GenerateRandBytes(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otp := base64.StdEncoding.EncodeToString(otpBytes)
+
+	err = c.RootGenerationInit(&RootGenerationInitConfig{
+		OTP:         otp,
+		MaxDuration: 5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	rgconf, err := c.RootGenerationConfiguration()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if rgconf == nil {
+		t.Fatalf("bad: no root generation config received")
+	}
+	if rgconf.ExpiresAt.Before(rgconf.StartedAt) {
+		t.Fatalf("bad: expires_at %s before started_at %s", rgconf.ExpiresAt, rgconf.StartedAt)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	// The expired attempt should be auto-cancelled on the next access.
+	conf, err := c.RootGenerationConfiguration()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf != nil {
+		t.Fatalf("bad: expected expired attempt to be cleared, got %#v", conf)
+	}
+
+	num, err := c.RootGenerationProgress()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if num != 0 {
+		t.Fatalf("bad: %d", num)
+	}
+
+	if _, err := c.RootGenerationUpdate(master, rgconf.Nonce, ""); err == nil {
+		t.Fatalf("expected error submitting a share against an expired attempt")
+	}
+
+	// A fresh attempt should be startable once the old one has expired.
+	if err := c.RootGenerationInit(&RootGenerationInitConfig{OTP: otp}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCore_RootGeneration_Audit(t *testing.T) {
+	c, master, _, noop := TestCoreUnsealedWithAudit(t)
+
+	otpBytes, err := xor.GenerateRandBytes(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otp := base64.StdEncoding.EncodeToString(otpBytes)
+
+	// The operator who submits the completing share may not be the one
+	// who started the attempt; both identities should be audited
+	// distinctly and neither should clobber the other.
+	if err := c.RootGenerationInit(&RootGenerationInitConfig{OTP: otp, Requestor: "operator-1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	rgconf, err := c.RootGenerationConfiguration()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if _, err := c.RootGenerationUpdate(master, rgconf.Nonce, "operator-2"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ops := make(map[string]bool)
+	for _, entry := range noop.Entries() {
+		ops[string(entry.Request.Operation)] = true
+	}
+	if !ops["root-generation/init"] {
+		t.Fatalf("bad: missing audit record for init")
+	}
+	if !ops["root-generation/update"] {
+		t.Fatalf("bad: missing audit record for update")
+	}
+	if !ops["root-generation/complete"] {
+		t.Fatalf("bad: missing audit record for complete")
+	}
+	if ops["root-generation/success"] {
+		t.Fatalf("bad: unexpected legacy root-generation/success op")
+	}
+
+	for _, entry := range noop.Entries() {
+		switch entry.Request.Operation {
+		case "root-generation/init":
+			if entry.Request.Data["nonce"] != rgconf.Nonce {
+				t.Fatalf("bad: expected nonce %s in audit record, got %v", rgconf.Nonce, entry.Request.Data["nonce"])
+			}
+			if entry.Auth.DisplayName != "operator-1" {
+				t.Fatalf("bad: expected init actor operator-1, got %s", entry.Auth.DisplayName)
+			}
+		case "root-generation/update":
+			if entry.Request.Data["share_fingerprint"] == nil {
+				t.Fatalf("bad: expected share fingerprint in audit record")
+			}
+			if entry.Auth.DisplayName != "operator-2" {
+				t.Fatalf("bad: expected update actor operator-2, got %s", entry.Auth.DisplayName)
+			}
+		case "root-generation/complete":
+			// The completion event is attributed to the operator who
+			// started the attempt, and lists the submitter of every
+			// counted share, not just the last one.
+			if entry.Auth.DisplayName != "operator-1" {
+				t.Fatalf("bad: expected complete actor operator-1, got %s", entry.Auth.DisplayName)
+			}
+			submitters, _ := entry.Request.Data["share_submitters"].([]string)
+			if len(submitters) != 1 || submitters[0] != "operator-2" {
+				t.Fatalf("bad: expected share_submitters [operator-2], got %v", submitters)
+			}
+		}
+	}
+
+	// A second, distinct attempt cancelled by yet another operator should
+	// audit that operator as the cancelling actor, not whoever happened
+	// to touch the first attempt.
+	if err := c.RootGenerationInit(&RootGenerationInitConfig{OTP: otp, Requestor: "operator-1"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := c.RootGenerationCancel("operator-3"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var sawCancel bool
+	for _, entry := range noop.Entries() {
+		if entry.Request.Operation == "root-generation/cancel" {
+			sawCancel = true
+			if entry.Auth.DisplayName != "operator-3" {
+				t.Fatalf("bad: expected cancel actor operator-3, got %s", entry.Auth.DisplayName)
+			}
+		}
+	}
+	if !sawCancel {
+		t.Fatalf("bad: missing audit record for cancel")
+	}
+}
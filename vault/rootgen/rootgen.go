@@ -0,0 +1,34 @@
+// Package rootgen provides an offline helper for reconstructing a root
+// token that was generated in multi-recipient PGP mode, where the token
+// is Shamir-split across several PGP-encrypted shares rather than
+// returned directly.
+package rootgen
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/shamir"
+)
+
+// Recombine reconstructs the root token from a threshold of shares that
+// have already been decrypted (e.g. with `gpg --decrypt`) from the
+// PGPShares returned by RootGenerationUpdate. Fewer than the configured
+// threshold of shares (but at least two) is not detected: no error is
+// returned, and the result is a well-formed but wrong token.
+func Recombine(shares [][]byte) (string, error) {
+	if len(shares) == 0 {
+		return "", fmt.Errorf("no shares provided")
+	}
+
+	tokenBytes, err := shamir.Combine(shares)
+	if err != nil {
+		return "", fmt.Errorf("failed to combine shares: %v", err)
+	}
+
+	token, err := uuid.FormatUUID(tokenBytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to format reconstructed root token: %v", err)
+	}
+	return token, nil
+}
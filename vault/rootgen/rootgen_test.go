@@ -0,0 +1,48 @@
+package rootgen
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/shamir"
+)
+
+func TestRecombine(t *testing.T) {
+	tokenBytes, err := uuid.GenerateRandomBytes(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := uuid.FormatUUID(tokenBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err := shamir.Split(tokenBytes, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Recombine(shares[0:3])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got != token {
+		t.Fatalf("bad: expected %s, got %s", token, got)
+	}
+
+	// Shamir's scheme gives no way to detect an under-threshold
+	// combination by itself; it just yields the wrong token.
+	bad, err := Recombine(shares[0:2])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if bad == token {
+		t.Fatalf("bad: recombined below threshold but got the correct token")
+	}
+}
+
+func TestRecombine_NoShares(t *testing.T) {
+	if _, err := Recombine(nil); err == nil {
+		t.Fatalf("expected error with no shares")
+	}
+}
@@ -0,0 +1,43 @@
+package vault
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// TestAuditEntry is one call recorded by TestNoopAudit.
+type TestAuditEntry struct {
+	Request *logical.Request
+	Auth    *logical.Auth
+}
+
+// TestNoopAudit is a minimal audit broker double for tests that need to
+// inspect what was audited rather than exercise a real audit backend. It
+// accepts every request and keeps a record of it instead of shipping it
+// anywhere.
+type TestNoopAudit struct {
+	entries []TestAuditEntry
+}
+
+// LogRequest implements the subset of the audit broker interface that
+// root generation depends on.
+func (n *TestNoopAudit) LogRequest(auth *logical.Auth, req *logical.Request, outerErr error) error {
+	n.entries = append(n.entries, TestAuditEntry{Request: req, Auth: auth})
+	return nil
+}
+
+// Entries returns every request/auth pair logged so far, in order.
+func (n *TestNoopAudit) Entries() []TestAuditEntry {
+	return append([]TestAuditEntry(nil), n.entries...)
+}
+
+// TestCoreUnsealedWithAudit is like TestCoreUnsealed, but wires a
+// TestNoopAudit in as the core's audit broker so tests can assert on what
+// was audited.
+func TestCoreUnsealedWithAudit(t *testing.T) (*Core, []byte, string, *TestNoopAudit) {
+	c, master, root := TestCoreUnsealed(t)
+	noop := &TestNoopAudit{}
+	c.auditBroker = noop
+	return c, master, root, noop
+}